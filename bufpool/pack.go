@@ -0,0 +1,32 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bufpool
+
+import "encoding/binary"
+
+// PackTCPBuffer returns a pooled buffer containing the 2-byte big-endian
+// length header required by RFC 1035 4.2.2 followed by raw, so a TCP/TLS
+// upstream can write both in a single Write call instead of allocating
+// a second, header-only buffer. The returned buffer must be released with
+// ReleaseMsgBuf.
+func PackTCPBuffer(raw []byte) []byte {
+	buf := AcquireMsgBuf(len(raw) + 2)
+	binary.BigEndian.PutUint16(buf, uint16(len(raw)))
+	copy(buf[2:], raw)
+	return buf
+}
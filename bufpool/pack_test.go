@@ -0,0 +1,42 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bufpool
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPackTCPBuffer(t *testing.T) {
+	raw := []byte{0xca, 0xfe, 0x00, 0x01, 0x00, 0x00}
+
+	buf := PackTCPBuffer(raw)
+	defer ReleaseMsgBuf(buf)
+
+	if len(buf) != len(raw)+2 {
+		t.Fatalf("len(buf) = %d, want %d", len(buf), len(raw)+2)
+	}
+	if n := binary.BigEndian.Uint16(buf[:2]); int(n) != len(raw) {
+		t.Fatalf("length header = %d, want %d", n, len(raw))
+	}
+	for i := range raw {
+		if buf[2+i] != raw[i] {
+			t.Fatalf("payload[%d] = %#x, want %#x", i, buf[2+i], raw[i])
+		}
+	}
+}
@@ -0,0 +1,115 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dohclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/sirupsen/logrus"
+)
+
+// HTTP3Client is a DoH client that speaks HTTP/3 over QUIC instead of
+// HTTP/1.1+fasthttp, so it can reuse a 0-RTT QUIC session across queries
+// and survive NAT rebinding better than DoH-over-TCP.
+type HTTP3Client struct {
+	url     string
+	addr    string
+	maxSize int
+	timeout time.Duration
+
+	c *http.Client
+}
+
+// NewHTTP3Client returns a DoH client backed by a quic-go http3.RoundTripper.
+// tlsConf.ClientSessionCache is expected to come from the caller's shared,
+// addr-keyed cache (see sharedQUICSessionCache in upstream.go) so a cached
+// session ticket for addr can be reused by a doq upstream to the same
+// resolver. The RoundTripper's dialer is pinned to addr, not whatever host
+// rawURL resolves to through the system resolver, matching every other
+// upstream type in this package.
+func NewHTTP3Client(rawURL, addr string, tlsConf *tls.Config, maxSize int, timeout time.Duration) (*HTTP3Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf.ServerName = u.Hostname()
+	}
+
+	return &HTTP3Client{
+		url:     rawURL,
+		addr:    addr,
+		maxSize: maxSize,
+		timeout: timeout,
+		c: &http.Client{
+			Transport: &http3.RoundTripper{
+				TLSClientConfig: tlsConf,
+				Dial: func(network, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlySession, error) {
+					// dial addr directly instead of whatever host rawURL
+					// happens to resolve to, so a doh3 upstream doesn't
+					// have to go through (possibly itself) to resolve its
+					// own hostname.
+					return quic.DialAddrEarly(addr, tlsCfg, cfg)
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *HTTP3Client) Exchange(ctx context.Context, qRaw []byte, requestLogger *logrus.Entry) (rRaw []byte, rtt time.Duration, err error) {
+	t := time.Now()
+	rRaw, err = c.exchange(ctx, qRaw)
+	return rRaw, time.Since(t), err
+}
+
+func (c *HTTP3Client) exchange(ctx context.Context, qRaw []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(qRaw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh3 server returned status code %d", resp.StatusCode)
+	}
+
+	rRaw, err := ioutil.ReadAll(ioutil.LimitReader(resp.Body, int64(c.maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	return rRaw, nil
+}
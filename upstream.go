@@ -21,15 +21,18 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mos-chinadns/utils"
 
 	"github.com/IrineSistiana/mos-chinadns/bufpool"
 	"github.com/IrineSistiana/mos-chinadns/dohclient"
+	"github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
@@ -40,6 +43,7 @@ type upstream interface {
 
 type upstreamTCP struct {
 	addr string
+	cp   *tcpConnPool
 }
 
 type upstreamUDP struct {
@@ -48,12 +52,36 @@ type upstreamUDP struct {
 	cp         *udpConnPool
 }
 
-func newUpstream(addr, prot, url string, rootCAs *x509.CertPool) (upstream, error) {
+var (
+	quicSessionCacheMu sync.Mutex
+	quicSessionCaches  = make(map[string]tls.ClientSessionCache)
+)
+
+// sharedQUICSessionCache returns a tls.ClientSessionCache shared by every
+// upstream dialing addr over QUIC, so a doq and a doh3 upstream pointed at
+// the same resolver can resume each other's 0-RTT session tickets instead
+// of each keeping its own, never-shared cache.
+func sharedQUICSessionCache(addr string) tls.ClientSessionCache {
+	quicSessionCacheMu.Lock()
+	defer quicSessionCacheMu.Unlock()
+	c, ok := quicSessionCaches[addr]
+	if !ok {
+		c = tls.NewLRUClientSessionCache(64)
+		quicSessionCaches[addr] = c
+	}
+	return c
+}
+
+func newUpstream(addr, prot, url, serverName string, rootCAs *x509.CertPool) (upstream, error) {
 	var client upstream
 	switch prot {
 	case "tcp":
 		client = &upstreamTCP{
 			addr: addr,
+			cp: newTCPConnPool(64, time.Second*10, func(ctx context.Context) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, "tcp", addr)
+			}),
 		}
 	case "udp", "":
 		udpAddr, err := net.ResolveUDPAddr("udp", addr)
@@ -76,6 +104,39 @@ func newUpstream(addr, prot, url string, rootCAs *x509.CertPool) (upstream, erro
 			return nil, fmt.Errorf("protocol [%s] needs URL", prot)
 		}
 		client = dohclient.NewClient(url, addr, tlsConf, dns.MaxMsgSize, queryTimeout)
+	case "doh3":
+		// shares its session cache with "doq" (keyed by addr below) so a
+		// cached QUIC session ticket for this addr can be reused by either.
+		tlsConf := &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            rootCAs,
+			ClientSessionCache: sharedQUICSessionCache(addr),
+			NextProtos:         []string{"h3"},
+		}
+
+		if len(url) == 0 {
+			return nil, fmt.Errorf("protocol [%s] needs URL", prot)
+		}
+		h3Client, err := dohclient.NewHTTP3Client(url, addr, tlsConf, dns.MaxMsgSize, queryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		client = h3Client
+	case "doq":
+		tlsConf := &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            rootCAs,
+			ClientSessionCache: sharedQUICSessionCache(addr),
+			NextProtos:         []string{"doq"},
+		}
+		client = newUpstreamDoQ(addr, tlsConf)
+	case "dot":
+		tlsConf := &tls.Config{
+			ServerName:         serverName,
+			RootCAs:            rootCAs,
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		}
+		client = newUpstreamDoT(addr, tlsConf)
 	default:
 		return nil, fmt.Errorf("unsupport protocol: %s", prot)
 	}
@@ -90,35 +151,315 @@ func (u *upstreamTCP) Exchange(ctx context.Context, qRaw []byte, _ *logrus.Entry
 }
 
 func (u *upstreamTCP) exchange(ctx context.Context, qRaw []byte) (rRaw []byte, err error) {
-	d := net.Dialer{}
-	c, err := d.DialContext(ctx, "tcp", u.addr)
+	pc, pooled, err := u.cp.getOrDial(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer c.Close()
+	rRaw, err = pc.exchange(ctx, qRaw)
+	if !pooled {
+		pc.close(nil) // overflowed the pool, nothing else will ever close it
+	}
+	return rRaw, err
+}
 
-	go func() {
-		select {
-		case <-ctx.Done():
-			c.SetDeadline(time.Now())
+// tcpConnPool keeps a handful of persistent, pipelined TCP connections
+// around so callers don't pay a dial (and TCP slow-start) per query.
+// Unlike udpConnPool a connection isn't removed from the pool while it's
+// in use: RFC 7766 pipelining means many callers can share one connection
+// at once, demultiplexed by DNS message ID.
+type tcpConnPool struct {
+	sync.Mutex
+	maxSize  int
+	ttl      time.Duration
+	dial     func(ctx context.Context) (net.Conn, error)
+	pool     []*pooledTCPConn
+	reserved int // dials in flight that have claimed a pool slot but not landed yet
+}
+
+func newTCPConnPool(maxSize int, ttl time.Duration, dial func(ctx context.Context) (net.Conn, error)) *tcpConnPool {
+	return &tcpConnPool{
+		maxSize: maxSize,
+		ttl:     ttl,
+		dial:    dial,
+		pool:    make([]*pooledTCPConn, 0, 4),
+	}
+}
+
+// getOrDial returns a connection to use for one query, evicting dead or
+// expired pooled connections as it goes, and dialing a fresh one if none
+// are usable. The returned pooled bool reports whether pc was (or will be)
+// kept in the pool: callers MUST close pc themselves once done with it
+// when pooled is false, since nothing else owns it.
+func (p *tcpConnPool) getOrDial(ctx context.Context) (pc *pooledTCPConn, pooled bool, err error) {
+	p.Lock()
+	res := p.pool[:0]
+	for _, c := range p.pool {
+		if !c.alive() || time.Since(c.lastUsed()) > c.effectiveTTL(p.ttl) {
+			c.close(nil)
+			continue
+		}
+		res = append(res, c)
+		if pc == nil {
+			pc = c
+		}
+	}
+	p.pool = res
+
+	if pc != nil {
+		p.Unlock()
+		pc.touch()
+		return pc, true, nil
+	}
+
+	// Claim a slot before dialing so a burst of concurrent first-use
+	// callers can't all dial past maxSize and then drop the overflow on
+	// the floor (leaking its socket and readLoop goroutine). Callers that
+	// lose the race for a slot still get a connection, just an unpooled
+	// one they're responsible for closing after use.
+	canPool := len(p.pool)+p.reserved < p.maxSize
+	if canPool {
+		p.reserved++
+	}
+	p.Unlock()
+
+	c, dialErr := p.dial(ctx)
+
+	if canPool {
+		p.Lock()
+		p.reserved--
+		p.Unlock()
+	}
+	if dialErr != nil {
+		return nil, false, dialErr
+	}
+
+	pc = newPooledTCPConn(c)
+	if canPool {
+		p.Lock()
+		p.pool = append(p.pool, pc)
+		p.Unlock()
+	}
+	return pc, canPool, nil
+}
+
+// pooledTCPConn wraps one TCP connection that may carry several in-flight
+// queries at once. A background goroutine reads length-prefixed responses
+// off the wire and demuxes them to the waiting caller by DNS message ID.
+type pooledTCPConn struct {
+	c net.Conn
+
+	nextID uint32 // atomically incremented, truncated to a connection-local wire ID
+
+	m        sync.Mutex
+	waiters  map[uint16]tcpWaiter
+	last     time.Time
+	idleTTL  time.Duration // RFC 7828 edns-tcp-keepalive, 0 if unset
+	closed   chan struct{}
+	closeErr error
+}
+
+// tcpWaiter is what a pipelined caller is waiting on. Replies are demuxed
+// by a connection-local wire ID rather than the caller's own DNS message
+// ID, since two callers pipelined on the same connection could otherwise
+// pick the same 16-bit ID and have one silently steal the other's reply;
+// origID is restored into the reply before it's handed back.
+type tcpWaiter struct {
+	ch     chan []byte
+	origID uint16
+}
+
+func newPooledTCPConn(c net.Conn) *pooledTCPConn {
+	pc := &pooledTCPConn{
+		c:       c,
+		waiters: make(map[uint16]tcpWaiter),
+		last:    time.Now(),
+		closed:  make(chan struct{}),
+	}
+	go pc.readLoop()
+	return pc
+}
+
+func (pc *pooledTCPConn) readLoop() {
+	for {
+		rRaw, err := readMsgFromTCP(pc.c)
+		if err != nil {
+			pc.close(err)
+			return
+		}
+
+		id := utils.GetMsgID(rRaw)
+		pc.m.Lock()
+		w, ok := pc.waiters[id]
+		if ok {
+			delete(pc.waiters, id)
+		}
+		pc.m.Unlock()
+
+		if ka, ok := parseKeepaliveOption(rRaw); ok {
+			pc.m.Lock()
+			pc.idleTTL = ka
+			pc.m.Unlock()
+		}
+
+		if !ok {
+			// no one (or a cancelled caller) is waiting for this reply.
+			bufpool.ReleaseMsgBuf(rRaw)
+			continue
+		}
+		setMsgID(rRaw, w.origID)
+		w.ch <- rRaw
+	}
+}
+
+// effectiveTTL returns the server-advertised edns-tcp-keepalive idle
+// timeout if the connection has seen one, otherwise the pool's default.
+func (pc *pooledTCPConn) effectiveTTL(poolDefault time.Duration) time.Duration {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	if pc.idleTTL > 0 {
+		return pc.idleTTL
+	}
+	return poolDefault
+}
+
+// parseKeepaliveOption extracts the RFC 7828 edns-tcp-keepalive timeout
+// from a DNS response, if present.
+func parseKeepaliveOption(rRaw []byte) (time.Duration, bool) {
+	r := new(dns.Msg)
+	if err := r.Unpack(rRaw); err != nil {
+		return 0, false
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return 0, false
+	}
+	for _, o := range opt.Option {
+		if ka, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok && ka.Timeout > 0 {
+			return time.Duration(ka.Timeout) * 100 * time.Millisecond, true
 		}
-	}()
+	}
+	return 0, false
+}
+
+func (pc *pooledTCPConn) exchange(ctx context.Context, qRaw []byte) (rRaw []byte, err error) {
+	origID := utils.GetMsgID(qRaw)
+	wireID := uint16(atomic.AddUint32(&pc.nextID, 1))
+	ch := make(chan []byte, 1)
 
-	err = writeMsgToTCP(c, qRaw)
+	pc.m.Lock()
+	pc.waiters[wireID] = tcpWaiter{ch: ch, origID: origID}
+	pc.last = time.Now()
+	pc.m.Unlock()
+
+	buf := bufpool.PackTCPBuffer(qRaw)
+	setMsgID(buf[2:], wireID) // buf is [2-byte length][wire message]
+	_, err = pc.c.Write(buf)
+	bufpool.ReleaseMsgBuf(buf)
 	if err != nil {
+		pc.close(err)
 		return nil, err
 	}
-	rRaw, err = readMsgFromTCP(c)
+
+	select {
+	case rRaw, ok := <-ch:
+		if !ok {
+			return nil, pc.closeErr
+		}
+		return rRaw, nil
+	case <-ctx.Done():
+		// the connection stays healthy for other pipelined callers; just
+		// drop this caller's slot.
+		pc.m.Lock()
+		delete(pc.waiters, wireID)
+		pc.m.Unlock()
+		return nil, ctx.Err()
+	case <-pc.closed:
+		return nil, pc.closeErr
+	}
+}
+
+// setMsgID overwrites the 16-bit DNS message ID in the first two bytes of
+// a wire-format message.
+func setMsgID(msg []byte, id uint16) {
+	binary.BigEndian.PutUint16(msg, id)
+}
+
+func (pc *pooledTCPConn) alive() bool {
+	select {
+	case <-pc.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+func (pc *pooledTCPConn) lastUsed() time.Time {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	return pc.last
+}
+
+func (pc *pooledTCPConn) touch() {
+	pc.m.Lock()
+	pc.last = time.Now()
+	pc.m.Unlock()
+}
+
+func (pc *pooledTCPConn) close(err error) {
+	pc.m.Lock()
+	select {
+	case <-pc.closed:
+		pc.m.Unlock()
+		return
+	default:
+	}
+	pc.closeErr = err
+	waiters := pc.waiters
+	pc.waiters = nil
+	close(pc.closed)
+	pc.m.Unlock()
+
+	pc.c.Close()
+	for _, w := range waiters {
+		close(w.ch)
+	}
+}
+
+// upstreamDoT is a DNS-over-TLS (RFC 7858) upstream. It reuses the same
+// pooled/pipelined TCP connection machinery as upstreamTCP, just dialing
+// over TLS and honoring the server's edns-tcp-keepalive (RFC 7828) hint.
+type upstreamDoT struct {
+	addr string
+	cp   *tcpConnPool
+}
+
+func newUpstreamDoT(addr string, tlsConf *tls.Config) *upstreamDoT {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		d := tls.Dialer{Config: tlsConf}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	return &upstreamDoT{
+		addr: addr,
+		cp:   newTCPConnPool(64, time.Second*10, dial),
+	}
+}
+
+func (u *upstreamDoT) Exchange(ctx context.Context, qRaw []byte, _ *logrus.Entry) (rRaw []byte, rtt time.Duration, err error) {
+	t := time.Now()
+	rRaw, err = u.exchange(ctx, qRaw)
+	return rRaw, time.Since(t), err
+}
+
+func (u *upstreamDoT) exchange(ctx context.Context, qRaw []byte) (rRaw []byte, err error) {
+	pc, pooled, err := u.cp.getOrDial(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	msgID := utils.GetMsgID(qRaw)
-	if utils.GetMsgID(rRaw) != msgID {
-		bufpool.ReleaseMsgBuf(rRaw)
-		return nil, dns.ErrId
+	rRaw, err = pc.exchange(ctx, qRaw)
+	if !pooled {
+		pc.close(nil) // overflowed the pool, nothing else will ever close it
 	}
-	return rRaw, nil
+	return rRaw, err
 }
 
 func (u *upstreamUDP) Exchange(ctx context.Context, qRaw []byte, _ *logrus.Entry) (rRaw []byte, rtt time.Duration, err error) {
@@ -128,66 +469,148 @@ func (u *upstreamUDP) Exchange(ctx context.Context, qRaw []byte, _ *logrus.Entry
 }
 
 func (u *upstreamUDP) exchange(ctx context.Context, qRaw []byte) (rRaw []byte, err error) {
-
-	var isNewConn bool
-	c := u.cp.get()
-	if c == nil {
-		c, err = net.DialUDP("udp", nil, u.addr)
+	pc := u.cp.get()
+	if pc == nil {
+		c, err := net.DialUDP("udp", nil, u.addr)
 		if err != nil {
 			return nil, err
 		}
-		isNewConn = true
+		pc = newPooledUDPConn(c)
 	}
-	c.SetDeadline(time.Time{})
 
-	once := sync.Once{}
-	go func() {
-		select {
-		case <-ctx.Done():
-			once.Do(func() { c.SetDeadline(time.Now()) })
-		}
-	}()
+	rRaw, err = pc.exchange(ctx, qRaw, u.maxUDPSize)
+	// pc's read loop keeps running and demuxing replies by ID regardless of
+	// whether this particular caller got one, so it's always safe to give
+	// it back to the pool; put() drops it if it has since died.
+	u.cp.put(pc)
+	return rRaw, err
+}
 
-	_, err = c.Write(qRaw)
+// pooledUDPConn wraps one UDP "connection" (really just a connected socket)
+// that may be shared by several concurrent callers. A read loop, started
+// lazily on first use, dispatches each incoming datagram to the caller
+// waiting on its DNS message ID via waiters, which replaces the previous
+// one-caller-per-socket goto-and-discard approach.
+type pooledUDPConn struct {
+	c      *net.UDPConn
+	once   sync.Once
+	nextID uint32 // atomically incremented, truncated to a connection-local wire ID
+
+	waiters sync.Map // uint16 wire ID -> udpWaiter
+
+	mu       sync.Mutex
+	closed   chan struct{}
+	closeErr error
+}
+
+// udpWaiter is what a pipelined caller is waiting on. Replies are demuxed
+// by a connection-local wire ID rather than the caller's own DNS message
+// ID, since two callers pipelined on the same socket could otherwise pick
+// the same 16-bit ID and have one silently steal the other's reply;
+// origID is restored into the reply before it's handed back.
+type udpWaiter struct {
+	ch     chan []byte
+	origID uint16
+}
+
+func newPooledUDPConn(c *net.UDPConn) *pooledUDPConn {
+	return &pooledUDPConn{
+		c:      c,
+		closed: make(chan struct{}),
+	}
+}
+
+func (pc *pooledUDPConn) exchange(ctx context.Context, qRaw []byte, maxUDPSize int) (rRaw []byte, err error) {
+	pc.once.Do(func() { go pc.readLoop(maxUDPSize) })
+
+	origID := utils.GetMsgID(qRaw)
+	wireID := uint16(atomic.AddUint32(&pc.nextID, 1))
+	ch := make(chan []byte, 1)
+	pc.waiters.Store(wireID, udpWaiter{ch: ch, origID: origID})
+
+	buf := bufpool.AcquireMsgBuf(len(qRaw))
+	copy(buf, qRaw)
+	setMsgID(buf, wireID)
+	_, err = pc.c.Write(buf)
+	bufpool.ReleaseMsgBuf(buf)
 	if err != nil {
-		c.Close()
+		pc.waiters.Delete(wireID)
+		pc.closeWithErr(err)
 		return nil, err
 	}
 
-	buf := bufpool.AcquireMsgBuf(u.maxUDPSize)
-read:
-	n, err := c.Read(buf)
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && ctx.Err() != nil {
-			// err caused by cancelled ctx, it's ok to reuse the connection
-			once.Do(func() {})
-			u.cp.put(c)
-			bufpool.ReleaseMsgBuf(buf)
-			return nil, err
+	select {
+	case rRaw, ok := <-ch:
+		if !ok {
+			return nil, pc.closeErr
 		}
-		c.Close()
-		bufpool.ReleaseMsgBuf(buf)
-		return nil, err
+		return rRaw, nil
+	case <-ctx.Done():
+		// the socket stays healthy for other pending/future callers, just
+		// drop this caller's waiter.
+		pc.waiters.Delete(wireID)
+		return nil, ctx.Err()
+	case <-pc.closed:
+		return nil, pc.closeErr
 	}
+}
 
-	if n < 12 {
-		err = dns.ErrShortRead
-		c.Close()
-		bufpool.ReleaseMsgBuf(buf)
-		return nil, err
+func (pc *pooledUDPConn) readLoop(maxUDPSize int) {
+	for {
+		buf := bufpool.AcquireMsgBuf(maxUDPSize)
+		n, err := pc.c.Read(buf)
+		if err != nil {
+			bufpool.ReleaseMsgBuf(buf)
+			pc.closeWithErr(err)
+			return
+		}
+
+		if n < 12 {
+			// too short to be a DNS message, ignore and keep listening
+			bufpool.ReleaseMsgBuf(buf)
+			continue
+		}
+
+		rRaw := buf[:n]
+		id := utils.GetMsgID(rRaw)
+		if wIface, ok := pc.waiters.LoadAndDelete(id); ok {
+			w := wIface.(udpWaiter)
+			setMsgID(rRaw, w.origID)
+			w.ch <- rRaw
+		} else {
+			// no one is waiting (already cancelled, or a stray reply)
+			bufpool.ReleaseMsgBuf(rRaw)
+		}
 	}
+}
 
-	rRaw = buf[:n]
-	if utils.GetMsgID(rRaw) != utils.GetMsgID(qRaw) && !isNewConn {
-		// this connection is reused, rRaw might be the reply
-		// of last qRaw, not this qRaw.
-		// try to read again
-		goto read
+func (pc *pooledUDPConn) alive() bool {
+	select {
+	case <-pc.closed:
+		return false
+	default:
+		return true
 	}
+}
 
-	once.Do(func() {})
-	u.cp.put(c)
-	return rRaw, nil
+func (pc *pooledUDPConn) closeWithErr(err error) {
+	pc.mu.Lock()
+	select {
+	case <-pc.closed:
+		pc.mu.Unlock()
+		return
+	default:
+	}
+	pc.closeErr = err
+	close(pc.closed)
+	pc.mu.Unlock()
+
+	pc.c.Close()
+	pc.waiters.Range(func(key, value interface{}) bool {
+		close(value.(udpWaiter).ch)
+		pc.waiters.Delete(key)
+		return true
+	})
 }
 
 type udpConnPool struct {
@@ -200,7 +623,7 @@ type udpConnPool struct {
 }
 
 type udpConnPoolElem struct {
-	*net.UDPConn
+	*pooledUDPConn
 	lastUsed time.Time
 }
 
@@ -216,7 +639,7 @@ func newUDPConnPool(size int, ttl, gcInterval time.Duration) *udpConnPool {
 
 // runCleanner must run under lock
 func (p *udpConnPool) runCleanner() {
-	if p == nil && len(p.pool) == 0 {
+	if p == nil || len(p.pool) == 0 {
 		return
 	}
 
@@ -226,12 +649,11 @@ func (p *udpConnPool) runCleanner() {
 		res := p.pool[:0]
 		for i := range p.pool {
 
-			// remove expired conns
-			if time.Since(p.pool[i].lastUsed) < p.ttl {
+			// remove expired or dead conns
+			if p.pool[i].alive() && time.Since(p.pool[i].lastUsed) < p.ttl {
 				res = append(res, p.pool[i])
-			} else { // expired, release the resources
-				p.pool[i].UDPConn.Close()
-				p.pool[i].UDPConn = nil
+			} else {
+				p.pool[i].closeWithErr(nil)
 			}
 		}
 		p.pool = res
@@ -244,24 +666,23 @@ func (p *udpConnPool) runCleanner() {
 		for i := range p.pool {
 			// forcely remove half conns first
 			if i < mid {
-				p.pool[i].UDPConn.Close()
-				p.pool[i].UDPConn = nil
+				p.pool[i].closeWithErr(nil)
+				continue
 			}
 
-			//then remove expired conns
-			if time.Since(p.pool[i].lastUsed) < p.ttl {
+			//then remove expired or dead conns
+			if p.pool[i].alive() && time.Since(p.pool[i].lastUsed) < p.ttl {
 				res = append(res, p.pool[i])
 			} else {
-				p.pool[i].UDPConn.Close()
-				p.pool[i].UDPConn = nil
+				p.pool[i].closeWithErr(nil)
 			}
 		}
 		p.pool = res
 	}
 }
 
-func (p *udpConnPool) put(c *net.UDPConn) {
-	if p == nil && p.maxSize <= 0 {
+func (p *udpConnPool) put(c *pooledUDPConn) {
+	if p == nil || p.maxSize <= 0 {
 		return
 	}
 
@@ -270,15 +691,19 @@ func (p *udpConnPool) put(c *net.UDPConn) {
 
 	p.runCleanner()
 
+	if !c.alive() {
+		return // lost the race with its own read loop, nothing to pool
+	}
+
 	if len(p.pool) >= p.maxSize {
-		c.Close() // pool is full, drop it
+		c.closeWithErr(nil) // pool is full, drop it
 	} else {
-		p.pool = append(p.pool, udpConnPoolElem{UDPConn: c, lastUsed: time.Now()})
+		p.pool = append(p.pool, udpConnPoolElem{pooledUDPConn: c, lastUsed: time.Now()})
 	}
 }
 
-func (p *udpConnPool) get() (c *net.UDPConn) {
-	if p == nil && p.maxSize <= 0 {
+func (p *udpConnPool) get() (c *pooledUDPConn) {
+	if p == nil || p.maxSize <= 0 {
 		return nil
 	}
 
@@ -291,11 +716,143 @@ func (p *udpConnPool) get() (c *net.UDPConn) {
 		e := p.pool[len(p.pool)-1]
 		p.pool = p.pool[:len(p.pool)-1]
 
-		if time.Since(e.lastUsed) > p.ttl {
-			e.UDPConn.Close() // expired
+		if !e.alive() || time.Since(e.lastUsed) > p.ttl {
+			e.closeWithErr(nil) // expired or already dead
 			return nil
 		}
-		return e.UDPConn
+		return e.pooledUDPConn
 	}
 	return nil
+}
+
+// upstreamDoQ is a DNS-over-QUIC (RFC 9250) upstream. It keeps a single
+// QUIC session open and multiplexes queries over it using one bidirectional
+// stream per query, re-dialing the session on demand when it has been
+// closed by the peer or has gone idle.
+type upstreamDoQ struct {
+	addr    string
+	tlsConf *tls.Config
+
+	m       sync.Mutex
+	session quic.EarlySession
+}
+
+func newUpstreamDoQ(addr string, tlsConf *tls.Config) *upstreamDoQ {
+	return &upstreamDoQ{
+		addr:    addr,
+		tlsConf: tlsConf,
+	}
+}
+
+func (u *upstreamDoQ) Exchange(ctx context.Context, qRaw []byte, _ *logrus.Entry) (rRaw []byte, rtt time.Duration, err error) {
+	t := time.Now()
+	rRaw, err = u.exchange(ctx, qRaw)
+	return rRaw, time.Since(t), err
+}
+
+func (u *upstreamDoQ) exchange(ctx context.Context, qRaw []byte) (rRaw []byte, err error) {
+	session, err := u.getSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		// the session might have been torn down by the peer or gone idle,
+		// drop it so the next query re-dials.
+		u.dropSession(session)
+		return nil, err
+	}
+	defer stream.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetReadDeadline(deadline)
+		stream.SetWriteDeadline(deadline)
+	}
+
+	lengthPrefixed := bufpool.AcquireMsgBuf(len(qRaw) + 2)
+	binary.BigEndian.PutUint16(lengthPrefixed, uint16(len(qRaw)))
+	copy(lengthPrefixed[2:], qRaw)
+	_, err = stream.Write(lengthPrefixed)
+	bufpool.ReleaseMsgBuf(lengthPrefixed)
+	if err != nil {
+		u.dropSession(session)
+		return nil, err
+	}
+	// a stream is used for exactly one query/response pair, so close the
+	// write side right away per RFC 9250 §4.2.
+	stream.Close()
+
+	var lengthBuf [2]byte
+	if _, err := readFull(stream, lengthBuf[:]); err != nil {
+		u.dropSession(session)
+		return nil, err
+	}
+	respLen := binary.BigEndian.Uint16(lengthBuf[:])
+	if respLen < 12 {
+		u.dropSession(session)
+		return nil, dns.ErrShortRead
+	}
+
+	rRaw = bufpool.AcquireMsgBuf(int(respLen))
+	if _, err := readFull(stream, rRaw); err != nil {
+		bufpool.ReleaseMsgBuf(rRaw)
+		u.dropSession(session)
+		return nil, err
+	}
+
+	if utils.GetMsgID(rRaw) != utils.GetMsgID(qRaw) {
+		bufpool.ReleaseMsgBuf(rRaw)
+		return nil, dns.ErrId
+	}
+	return rRaw, nil
+}
+
+// getSession returns the current QUIC session, lazily dialing a new one if
+// none is established yet. It dials through DialAddrEarlyContext so that,
+// when u.tlsConf.ClientSessionCache holds a ticket for this addr, the
+// session starts sending 0-RTT data (including the first query's stream)
+// before the TLS handshake has completed.
+func (u *upstreamDoQ) getSession(ctx context.Context) (quic.EarlySession, error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if u.session != nil {
+		select {
+		case <-u.session.Context().Done():
+			u.session = nil // closed by qerr.ApplicationError or idle timeout, reconnect
+		default:
+			return u.session, nil
+		}
+	}
+
+	session, err := quic.DialAddrEarlyContext(ctx, u.addr, u.tlsConf, &quic.Config{
+		HandshakeIdleTimeout: queryTimeout,
+		MaxIdleTimeout:       time.Minute,
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.session = session
+	return session, nil
+}
+
+func (u *upstreamDoQ) dropSession(session quic.EarlySession) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if u.session == session {
+		u.session = nil
+	}
+}
+
+func readFull(stream quic.Stream, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := stream.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
 }
\ No newline at end of file
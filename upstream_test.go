@@ -0,0 +1,287 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeTCPDNSServer reads length-prefixed wire messages off conn and echoes
+// each one straight back, optionally after delay, so tests can drive
+// pooledTCPConn without a real upstream resolver.
+func fakeTCPDNSServer(conn net.Conn, delay time.Duration) {
+	go func() {
+		for {
+			var lenBuf [2]byte
+			if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint16(lenBuf[:])
+			q := make([]byte, n)
+			if _, err := io.ReadFull(conn, q); err != nil {
+				return
+			}
+
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+
+			out := make([]byte, 2+len(q))
+			binary.BigEndian.PutUint16(out, n)
+			copy(out[2:], q)
+			if _, err := conn.Write(out); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func packQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	m := new(dns.Msg)
+	m.Id = id
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	raw, err := m.Pack()
+	if err != nil {
+		t.Fatalf("pack query: %v", err)
+	}
+	return raw
+}
+
+// Two callers pipelined on the same pooledTCPConn that happen to reuse the
+// same DNS message ID must not have their replies cross-delivered: the
+// wire ID demuxing the pool uses internally is connection-local, not the
+// caller-chosen DNS ID.
+func TestPooledTCPConnSameDNSIDDoesNotCollide(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	fakeTCPDNSServer(serverConn, 20*time.Millisecond)
+
+	pc := newPooledTCPConn(clientConn)
+	defer pc.close(nil)
+
+	qA := packQuery(t, 0x1234, "a.example.com.")
+	qB := packQuery(t, 0x1234, "b.example.com.")
+
+	type result struct {
+		raw []byte
+		err error
+	}
+	resA := make(chan result, 1)
+	resB := make(chan result, 1)
+
+	go func() {
+		raw, err := pc.exchange(context.Background(), qA)
+		resA <- result{raw, err}
+	}()
+	go func() {
+		raw, err := pc.exchange(context.Background(), qB)
+		resB <- result{raw, err}
+	}()
+
+	rA := <-resA
+	rB := <-resB
+	if rA.err != nil {
+		t.Fatalf("exchange A: %v", rA.err)
+	}
+	if rB.err != nil {
+		t.Fatalf("exchange B: %v", rB.err)
+	}
+
+	mA := new(dns.Msg)
+	if err := mA.Unpack(rA.raw); err != nil {
+		t.Fatalf("unpack reply A: %v", err)
+	}
+	mB := new(dns.Msg)
+	if err := mB.Unpack(rB.raw); err != nil {
+		t.Fatalf("unpack reply B: %v", err)
+	}
+
+	if mA.Id != 0x1234 || mB.Id != 0x1234 {
+		t.Fatalf("original DNS ID wasn't restored: got A=%#x B=%#x", mA.Id, mB.Id)
+	}
+	if len(mA.Question) == 0 || mA.Question[0].Name != dns.Fqdn("a.example.com.") {
+		t.Fatalf("caller A got the wrong reply: %+v", mA.Question)
+	}
+	if len(mB.Question) == 0 || mB.Question[0].Name != dns.Fqdn("b.example.com.") {
+		t.Fatalf("caller B got the wrong reply: %+v", mB.Question)
+	}
+}
+
+// A burst of concurrent first-use callers racing tcpConnPool.getOrDial
+// must never dial past maxSize connections into the pool; any overflow
+// connection is handed back unpooled so the caller can (and, per
+// upstreamTCP/upstreamDoT, does) close it instead of leaking it.
+func TestTCPConnPoolOverflowIsNotPooled(t *testing.T) {
+	const maxSize = 2
+	const concurrency = 6
+
+	dial := func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		fakeTCPDNSServer(server, 0)
+		return client, nil
+	}
+
+	p := newTCPConnPool(maxSize, time.Minute, dial)
+
+	type got struct {
+		pc     *pooledTCPConn
+		pooled bool
+	}
+	results := make(chan got, concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pc, pooled, err := p.getOrDial(context.Background())
+			if err != nil {
+				t.Errorf("getOrDial: %v", err)
+				return
+			}
+			results <- got{pc, pooled}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	// a caller arriving after a dial has landed reuses that pooled
+	// connection, so count distinct pooled connections, not results.
+	pooledConns := make(map[*pooledTCPConn]struct{})
+	for r := range results {
+		if r.pooled {
+			pooledConns[r.pc] = struct{}{}
+			continue
+		}
+		// mirrors what upstreamTCP/upstreamDoT do with an overflow
+		// connection: close it since nothing else owns it.
+		r.pc.close(nil)
+		if r.pc.alive() {
+			t.Fatalf("overflow connection was left open (leaked)")
+		}
+	}
+
+	pooledCount := len(pooledConns)
+	if pooledCount > maxSize {
+		t.Fatalf("pool ended up with %d connections, want at most %d", pooledCount, maxSize)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if len(p.pool) != pooledCount {
+		t.Fatalf("pool.pool has %d entries, want %d", len(p.pool), pooledCount)
+	}
+}
+
+// fakeUDPDNSEchoServer reads datagrams off conn and writes each one back to
+// its sender, after delay, so tests can drive pooledUDPConn without a real
+// upstream resolver.
+func fakeUDPDNSEchoServer(conn *net.UDPConn, delay time.Duration) {
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			q := append([]byte(nil), buf[:n]...)
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			if _, err := conn.WriteToUDP(q, addr); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Two callers pipelined on the same pooledUDPConn that happen to reuse the
+// same DNS message ID must not have their replies cross-delivered: the
+// wire ID demuxing the pool uses internally is connection-local, not the
+// caller-chosen DNS ID.
+func TestPooledUDPConnSameDNSIDDoesNotCollide(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer serverConn.Close()
+	fakeUDPDNSEchoServer(serverConn, 20*time.Millisecond)
+
+	clientConn, err := net.DialUDP("udp", nil, serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	pc := newPooledUDPConn(clientConn)
+	defer pc.closeWithErr(nil)
+
+	qA := packQuery(t, 0x1234, "a.example.com.")
+	qB := packQuery(t, 0x1234, "b.example.com.")
+
+	type result struct {
+		raw []byte
+		err error
+	}
+	resA := make(chan result, 1)
+	resB := make(chan result, 1)
+
+	go func() {
+		raw, err := pc.exchange(context.Background(), qA, 4096)
+		resA <- result{raw, err}
+	}()
+	go func() {
+		raw, err := pc.exchange(context.Background(), qB, 4096)
+		resB <- result{raw, err}
+	}()
+
+	rA := <-resA
+	rB := <-resB
+	if rA.err != nil {
+		t.Fatalf("exchange A: %v", rA.err)
+	}
+	if rB.err != nil {
+		t.Fatalf("exchange B: %v", rB.err)
+	}
+
+	mA := new(dns.Msg)
+	if err := mA.Unpack(rA.raw); err != nil {
+		t.Fatalf("unpack reply A: %v", err)
+	}
+	mB := new(dns.Msg)
+	if err := mB.Unpack(rB.raw); err != nil {
+		t.Fatalf("unpack reply B: %v", err)
+	}
+
+	if mA.Id != 0x1234 || mB.Id != 0x1234 {
+		t.Fatalf("original DNS ID wasn't restored: got A=%#x B=%#x", mA.Id, mB.Id)
+	}
+	if len(mA.Question) == 0 || mA.Question[0].Name != dns.Fqdn("a.example.com.") {
+		t.Fatalf("caller A got the wrong reply: %+v", mA.Question)
+	}
+	if len(mB.Question) == 0 || mB.Question[0].Name != dns.Fqdn("b.example.com.") {
+		t.Fatalf("caller B got the wrong reply: %+v", mB.Question)
+	}
+}